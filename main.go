@@ -5,24 +5,56 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const numResolvers = 4
 const matchSuffix = ".hosts"
 
+const (
+	formatLegacy  = "legacy"
+	formatHosts   = "hosts"
+	formatJSON    = "json"
+	formatRFC1035 = "rfc1035"
+)
+
+const (
+	qtypeA    = "a"
+	qtypeAAAA = "aaaa"
+	qtypeBoth = "both"
+)
+
+// dnsTypeA and dnsTypeAAAA are the RFC 1035 / RFC 3596 record type values
+// used when constructing raw DNS queries for the -dot and -doh resolvers.
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsClassIN  uint16 = 1
+)
+
 type resolveHostInfo struct {
-	path, host string
-	ip         []net.IP
-	err        error
+	path, host, source string
+	ip                 []net.IP
+	err                error
 }
 type hostAddressInfo struct {
 	hosts []resolveHostInfo
@@ -33,6 +65,21 @@ var resolveChannel chan resolveHostInfo
 var resolvedHosts hostAddressInfo
 
 var walkDir = flag.String("dir", ".", "The directory to look in for host files to resolve.")
+var numWorkers = flag.Int("workers", runtime.NumCPU(), "The number of worker goroutines to use for resolving hosts.")
+var lookupTimeout = flag.Duration("timeout", 5*time.Second, "The maximum amount of time to wait for a single host to resolve.")
+var recursive = flag.Bool("recursive", false, "Descend into subdirectories of -dir when looking for host files.")
+var exclude = flag.String("exclude", "", "A comma-separated list of glob patterns, matched against paths relative to -dir, to exclude from the walk.")
+var format = flag.String("format", formatLegacy, "The output format to write: legacy, hosts, json, or rfc1035.")
+var cachePath = flag.String("cache", "", "Path to a JSON file used to cache resolved hosts across runs.")
+var cacheTTL = flag.Duration("cache-ttl", time.Hour, "How long a successful resolution remains valid in the cache.")
+var negativeTTL = flag.Duration("negative-ttl", time.Minute, "How long a failed resolution remains valid in the cache.")
+var dnsServers = flag.String("dns", "", "Comma-separated list of host:port upstream DNS servers to query directly, bypassing the system resolver.")
+var dotServers = flag.String("dot", "", "Comma-separated list of host[:port] upstream DNS-over-TLS servers to query (default port 853).")
+var dohEndpoint = flag.String("doh", "", "A DNS-over-HTTPS endpoint to query, e.g. https://cloudflare-dns.com/dns-query.")
+var qtype = flag.String("qtype", qtypeBoth, "Which record types to resolve: a, aaaa, or both.")
+
+var excludePatterns []string
+var cache *hostCache
 
 func init() {
 	log.SetPrefix("resolve-hosts: ")
@@ -45,84 +92,197 @@ func init() {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if *numWorkers < 1 {
+		log.Println("-workers must be at least 1")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *exclude != "" {
+		excludePatterns = strings.Split(*exclude, ",")
+	}
+	switch *format {
+	case formatLegacy, formatHosts, formatJSON, formatRFC1035:
+	default:
+		log.Printf("unknown -format %q\n", *format)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *cachePath != "" {
+		var err error
+		cache, err = loadCache(*cachePath)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	switch *qtype {
+	case qtypeA, qtypeAAAA, qtypeBoth:
+	default:
+		log.Printf("unknown -qtype %q\n", *qtype)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
 }
 
 func main() {
-	// Set up channels and spin up resolvers.
-	resolveChannel = make(chan resolveHostInfo, numResolvers*2)
-	defer close(resolveChannel)
-	processingHostChannel := make(chan interface{}, numResolvers+1)
-	defer close(processingHostChannel)
+	resolver := newResolver()
 
-	for i := 0; i < numResolvers; i++ {
-		go resolveHost(resolveChannel, processingHostChannel)
+	// Set up the job channel and spin up the worker pool.
+	resolveChannel = make(chan resolveHostInfo, *numWorkers*2)
+	var workers sync.WaitGroup
+	workers.Add(*numWorkers)
+	for i := 0; i < *numWorkers; i++ {
+		go resolveHost(resolveChannel, &workers, resolver)
 	}
 
-	// Parse host files found in the specified directory.
-	filepath.Walk(*walkDir, parseHostFiles)
-	for {
-		if len(resolveChannel) == 0 && len(processingHostChannel) == 0 {
-			break
+	// Parse host files found in the specified directory, then close the job
+	// channel so that workers exit their loop once it's drained.
+	filepath.WalkDir(*walkDir, parseHostFiles)
+	close(resolveChannel)
+	workers.Wait()
+
+	if cache != nil {
+		if err := cache.save(*cachePath); err != nil {
+			log.Println(err)
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
 
-	// Write the resolved hosts to disk.
-	outputFiles := make(map[string]*os.File)
-	errorFiles := make(map[string]interface{})
+	// Group the resolved hosts by their destination file, then write each
+	// group out in the requested format.
+	hostsByPath := make(map[string][]resolveHostInfo)
 	for _, host := range resolvedHosts.hosts {
-		// If writing to a file has failed, don't continue trying to write to it.
-		if _, exists := errorFiles[host.path]; exists {
+		hostsByPath[host.path] = append(hostsByPath[host.path], host)
+	}
+	for path, hosts := range hostsByPath {
+		output, err := formatOutput(*format, hosts)
+		if err != nil {
+			log.Println(err)
 			continue
 		}
 
-		// Attempt to open the file, and store the handle for re-use.
-		file, open := outputFiles[host.path]
-		if !open {
-			file, err := os.Create(host.path)
-			if err != nil {
-				errorFiles[host.path] = nil
-				log.Println(err)
-				continue
-			}
-			outputFiles[host.path] = file
+		file, err := os.Create(path)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
-		if file == nil {
-			file = outputFiles[host.path]
+		if n, err := file.WriteString(output); err != nil {
+			log.Println(err)
+		} else if n != len(output) {
+			log.Printf("%s: expected to write %d bytes, actually wrote %d.\n", path, len(output), n)
 		}
+		file.Close()
+	}
+}
 
-		// Write the output string to the file.
-		var output string
+// formatOutput renders hosts, all destined for the same output file, in the
+// given format.
+func formatOutput(format string, hosts []resolveHostInfo) (string, error) {
+	switch format {
+	case formatHosts:
+		return formatHostsOutput(hosts), nil
+	case formatJSON:
+		return formatJSONOutput(hosts)
+	case formatRFC1035:
+		return formatRFC1035Output(hosts), nil
+	default:
+		return formatLegacyOutput(hosts), nil
+	}
+}
+
+func formatLegacyOutput(hosts []resolveHostInfo) string {
+	var output strings.Builder
+	for _, host := range hosts {
 		if host.err != nil {
-			output = "# " + host.err.Error() + "\n"
-		} else {
-			output = "# " + host.host + "\n"
-			for _, ip := range host.ip {
-				output += ip.String() + "\n"
-			}
+			output.WriteString("# " + host.err.Error() + "\n")
+			continue
 		}
-		n, err := file.WriteString(output)
-		if err != nil {
-			errorFiles[host.path] = nil
-			log.Println(err)
-		} else if n != len(output) {
-			errorFiles[host.path] = nil
-			log.Printf("%s: expected to write %d bytes, actually wrote %d.\n", host.path, len(output), n)
+		output.WriteString("# " + host.host + "\n")
+		for _, ip := range host.ip {
+			output.WriteString(ip.String() + "\n")
 		}
 	}
-	for _, file := range outputFiles {
-		file.Close()
+	return output.String()
+}
+
+// formatHostsOutput renders hosts as standard /etc/hosts lines, suitable for
+// concatenating directly into a system hosts file.
+func formatHostsOutput(hosts []resolveHostInfo) string {
+	var output strings.Builder
+	for _, host := range hosts {
+		if host.err != nil {
+			continue
+		}
+		for _, ip := range host.ip {
+			output.WriteString(ip.String() + "\t" + host.host + "\n")
+		}
+	}
+	return output.String()
+}
+
+type jsonHostEntry struct {
+	Host   string   `json:"host"`
+	IPs    []string `json:"ips"`
+	Error  string   `json:"error,omitempty"`
+	Source string   `json:"source"`
+}
+
+func formatJSONOutput(hosts []resolveHostInfo) (string, error) {
+	entries := make([]jsonHostEntry, len(hosts))
+	for i, host := range hosts {
+		entry := jsonHostEntry{Host: host.host, Source: host.source}
+		if host.err != nil {
+			entry.Error = host.err.Error()
+		}
+		entry.IPs = make([]string, len(host.ip))
+		for j, ip := range host.ip {
+			entry.IPs[j] = ip.String()
+		}
+		entries[i] = entry
+	}
+	output, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(output) + "\n", nil
+}
+
+// formatRFC1035Output renders hosts as a BIND-style zone snippet, with one
+// A or AAAA record per resolved address.
+func formatRFC1035Output(hosts []resolveHostInfo) string {
+	var output strings.Builder
+	for _, host := range hosts {
+		if host.err != nil {
+			output.WriteString("; " + host.err.Error() + "\n")
+			continue
+		}
+		for _, ip := range host.ip {
+			recordType := "A"
+			if ip.To4() == nil {
+				recordType = "AAAA"
+			}
+			fmt.Fprintf(&output, "%s\tIN\t%s\t%s\n", host.host, recordType, ip.String())
+		}
 	}
+	return output.String()
 }
 
-func parseHostFiles(path string, info os.FileInfo, err error) error {
+func parseHostFiles(path string, entry fs.DirEntry, err error) error {
 	// FIXME: Is this check needed?
 	if err != nil {
 		return err
 	}
-	// Ignore directories except the base directory.
-	if info.IsDir() && path != *walkDir {
-		return filepath.SkipDir
+	// Ignore directories except the base directory, unless -recursive was given.
+	if entry.IsDir() {
+		if path != *walkDir && !*recursive {
+			return filepath.SkipDir
+		}
+		if isExcluded(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if isExcluded(path) {
+		return nil
 	}
 	// Ignore files that don't match the desired suffix.
 	if matched, err := filepath.Match("*"+matchSuffix, filepath.Base(path)); !matched || err != nil {
@@ -144,21 +304,443 @@ func parseHostFiles(path string, info os.FileInfo, err error) error {
 		if len(host) == 0 || host[0] == '#' {
 			continue
 		}
-		resolveChannel <- resolveHostInfo{path[:len(path)-len(matchSuffix)], host, nil, nil}
+		hostInfo := resolveHostInfo{path: path[:len(path)-len(matchSuffix)], host: host, source: path}
+		if cache != nil {
+			if cached, hit := cache.get(host); hit {
+				hostInfo.ip = parseCachedIPs(cached.IPs)
+				if cached.Error != "" {
+					hostInfo.err = errors.New(cached.Error)
+				}
+				resolvedHosts.Lock()
+				resolvedHosts.hosts = append(resolvedHosts.hosts, hostInfo)
+				resolvedHosts.Unlock()
+				continue
+			}
+		}
+		resolveChannel <- hostInfo
 	}
 
 	return nil
 }
 
-func resolveHost(resolve <-chan resolveHostInfo, processing chan interface{}) {
-	for {
-		// FIXME: There's a possible race condition here.
-		hostInfo := <-resolve
-		processing <- nil
-		hostInfo.ip, hostInfo.err = net.LookupIP(hostInfo.host)
+// cacheEntry is the on-disk representation of a single cached resolution.
+type cacheEntry struct {
+	IPs        []string      `json:"ips"`
+	ResolvedAt time.Time     `json:"resolved_at"`
+	TTL        time.Duration `json:"ttl"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func (e cacheEntry) expired() bool {
+	return time.Now().After(e.ResolvedAt.Add(e.TTL))
+}
+
+// hostCache is a persistent, JSON-backed cache of hostname resolutions,
+// keyed by hostname.
+type hostCache struct {
+	sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// loadCache reads a hostCache from path. A missing file is treated as an
+// empty cache rather than an error.
+func loadCache(path string) (*hostCache, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &hostCache{entries: make(map[string]cacheEntry)}, nil
+		}
+		return nil, err
+	}
+	entries := make(map[string]cacheEntry)
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &entries); err != nil {
+			return nil, err
+		}
+	}
+	return &hostCache{entries: entries}, nil
+}
+
+// get returns the cached entry for host, if one exists and hasn't expired.
+func (c *hostCache) get(host string) (cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, exists := c.entries[host]
+	if !exists || entry.expired() {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// put records the outcome of resolving host, using cacheTTL for a successful
+// resolution or negativeTTL for a failed one.
+func (c *hostCache) put(host string, ip []net.IP, err error) {
+	entry := cacheEntry{ResolvedAt: time.Now(), TTL: *cacheTTL}
+	if err != nil {
+		entry.TTL = *negativeTTL
+		entry.Error = err.Error()
+	} else {
+		entry.IPs = make([]string, len(ip))
+		for i, addr := range ip {
+			entry.IPs[i] = addr.String()
+		}
+	}
+	c.Lock()
+	c.entries[host] = entry
+	c.Unlock()
+}
+
+// save writes the cache to path as JSON.
+func (c *hostCache) save(path string) error {
+	c.Lock()
+	contents, err := json.MarshalIndent(c.entries, "", "\t")
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+// parseCachedIPs converts the string-encoded addresses stored in a cache
+// entry back into net.IPs.
+func parseCachedIPs(ips []string) []net.IP {
+	parsed := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		parsed[i] = net.ParseIP(ip)
+	}
+	return parsed
+}
+
+// isExcluded reports whether path, relative to -dir, matches any of the
+// glob patterns given via -exclude.
+func isExcluded(path string) bool {
+	rel, err := filepath.Rel(*walkDir, path)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range excludePatterns {
+		if matched, err := filepath.Match(pattern, rel); matched && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveHost(resolve <-chan resolveHostInfo, workers *sync.WaitGroup, resolver Resolver) {
+	defer workers.Done()
+
+	for hostInfo := range resolve {
+		ctx, cancel := context.WithTimeout(context.Background(), *lookupTimeout)
+		hostInfo.ip, hostInfo.err = resolver.Resolve(ctx, hostInfo.host)
+		cancel()
+
+		if cache != nil {
+			cache.put(hostInfo.host, hostInfo.ip, hostInfo.err)
+		}
+
 		resolvedHosts.Lock()
 		resolvedHosts.hosts = append(resolvedHosts.hosts, hostInfo)
 		resolvedHosts.Unlock()
-		<-processing
+	}
+}
+
+// Resolver resolves a hostname to its IP addresses, honoring -qtype.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// newResolver builds the Resolver selected by the -doh, -dot, and -dns
+// flags, falling back to the system resolver.
+func newResolver() Resolver {
+	switch {
+	case *dohEndpoint != "":
+		return &dohResolver{endpoint: *dohEndpoint, client: &http.Client{}}
+	case *dotServers != "":
+		return &dotResolver{servers: strings.Split(*dotServers, ",")}
+	case *dnsServers != "":
+		return &stdResolver{resolver: dialingResolver(strings.Split(*dnsServers, ","))}
+	default:
+		return &stdResolver{resolver: &net.Resolver{}}
+	}
+}
+
+// recordTypes returns the DNS record types to query for, based on -qtype.
+func recordTypes() []uint16 {
+	switch *qtype {
+	case qtypeA:
+		return []uint16{dnsTypeA}
+	case qtypeAAAA:
+		return []uint16{dnsTypeAAAA}
+	default:
+		return []uint16{dnsTypeA, dnsTypeAAAA}
+	}
+}
+
+// nextUpstream round-robins through a list of upstream servers.
+var upstreamIndex uint64
+
+func nextUpstream(servers []string) string {
+	i := atomic.AddUint64(&upstreamIndex, 1) - 1
+	return strings.TrimSpace(servers[i%uint64(len(servers))])
+}
+
+// dialingResolver builds a net.Resolver that dials one of servers instead of
+// the system's configured resolver.
+func dialingResolver(servers []string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, nextUpstream(servers))
+		},
+	}
+}
+
+// stdResolver uses a net.Resolver (either the system resolver, or one
+// configured via -dns) and filters the result by -qtype.
+type stdResolver struct {
+	resolver *net.Resolver
+}
+
+func (r *stdResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	wantA, wantAAAA := *qtype != qtypeAAAA, *qtype != qtypeA
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if wantA {
+				ips = append(ips, addr.IP)
+			}
+		} else if wantAAAA {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, nil
+}
+
+// dotResolver resolves hosts by speaking RFC 1035 framed DNS messages over
+// a TLS connection to one of servers, selected via -dot.
+type dotResolver struct {
+	servers []string
+}
+
+func (r *dotResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addr := nextUpstream(r.servers)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+
+	var dialer tls.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var ips []net.IP
+	for _, rtype := range recordTypes() {
+		query, id, err := buildDNSQuery(host, rtype)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFramed(conn, query); err != nil {
+			return nil, err
+		}
+		response, err := readFramed(conn)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := parseDNSResponse(response, id)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips, nil
+}
+
+func writeFramed(w io.Writer, message []byte) error {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(message)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+func readFramed(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// dohResolver resolves hosts via DNS-over-HTTPS, POSTing a raw DNS message
+// to endpoint as described in RFC 8484.
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (r *dohResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, rtype := range recordTypes() {
+		query, id, err := buildDNSQuery(host, rtype)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("doh: %s: unexpected status %s", host, resp.Status)
+		}
+
+		addrs, err := parseDNSResponse(body, id)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips, nil
+}
+
+// dnsQueryID is a counter used to generate DNS message IDs; it need not be
+// unpredictable, only distinct enough to match a response to its query.
+var dnsQueryID uint32
+
+// buildDNSQuery encodes a single-question RFC 1035 query for host's A or
+// AAAA records.
+func buildDNSQuery(host string, rtype uint16) (message []byte, id uint16, err error) {
+	id = uint16(atomic.AddUint32(&dnsQueryID, 1))
+
+	var buf bytes.Buffer
+	header := [12]byte{}
+	binary.BigEndian.PutUint16(header[0:2], id)
+	header[2] = 0x01                           // RD
+	binary.BigEndian.PutUint16(header[4:6], 1) // QDCOUNT
+	buf.Write(header[:])
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, 0, fmt.Errorf("dns: label %q too long", label)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+
+	var qtypeClass [4]byte
+	binary.BigEndian.PutUint16(qtypeClass[0:2], rtype)
+	binary.BigEndian.PutUint16(qtypeClass[2:4], dnsClassIN)
+	buf.Write(qtypeClass[:])
+
+	return buf.Bytes(), id, nil
+}
+
+// parseDNSResponse extracts A/AAAA answer addresses from an RFC 1035
+// response message, verifying that it answers the query with the given id.
+func parseDNSResponse(message []byte, id uint16) ([]net.IP, error) {
+	if len(message) < 12 {
+		return nil, errors.New("dns: response too short")
+	}
+	if binary.BigEndian.Uint16(message[0:2]) != id {
+		return nil, errors.New("dns: response id mismatch")
+	}
+	if message[3]&0x0f != 0 {
+		return nil, fmt.Errorf("dns: response returned error code %d", message[3]&0x0f)
+	}
+	qdcount := binary.BigEndian.Uint16(message[4:6])
+	ancount := binary.BigEndian.Uint16(message[6:8])
+
+	offset := 12
+	for i := uint16(0); i < qdcount; i++ {
+		next, err := skipDNSName(message, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4 // QTYPE + QCLASS
+	}
+
+	var ips []net.IP
+	for i := uint16(0); i < ancount; i++ {
+		next, err := skipDNSName(message, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+		if offset+10 > len(message) {
+			return nil, errors.New("dns: truncated answer record")
+		}
+		rtype := binary.BigEndian.Uint16(message[offset : offset+2])
+		rdlength := int(binary.BigEndian.Uint16(message[offset+8 : offset+10]))
+		offset += 10
+		if offset+rdlength > len(message) {
+			return nil, errors.New("dns: truncated rdata")
+		}
+		rdata := message[offset : offset+rdlength]
+		switch rtype {
+		case dnsTypeA:
+			if len(rdata) == net.IPv4len {
+				ips = append(ips, net.IP(rdata))
+			}
+		case dnsTypeAAAA:
+			if len(rdata) == net.IPv6len {
+				ips = append(ips, net.IP(rdata))
+			}
+		}
+		offset += rdlength
+	}
+	return ips, nil
+}
+
+// skipDNSName advances past a possibly-compressed DNS name starting at
+// offset, returning the offset of the byte following it.
+func skipDNSName(message []byte, offset int) (int, error) {
+	for {
+		if offset >= len(message) {
+			return 0, errors.New("dns: name runs past end of message")
+		}
+		length := message[offset]
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(message) {
+				return 0, errors.New("dns: truncated name pointer")
+			}
+			return offset + 2, nil
+		default:
+			offset += int(length) + 1
+		}
 	}
 }